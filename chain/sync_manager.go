@@ -1,20 +1,84 @@
 package chain
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/types"
 
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 )
 
 var BootstrapPeerThreshold = 2
 
+// MaxSyncWorkers bounds the number of sync workers that may be running
+// concurrently. It exists to stop a burst of fork candidates from spawning
+// unbounded goroutines against doSync; excess targets are parked and drained
+// as running workers complete.
+var MaxSyncWorkers = 5
+
+// RecentSyncBufferSize is the number of completed syncs that the syncManager
+// retains for post-mortem inspection via RecentSyncs.
+var RecentSyncBufferSize = 10
+
+// InitialSyncTimeThreshold bounds how long the manager will stay in
+// bootstrap mode on wall-clock time alone, in case the epoch-distance check
+// in updateBootstrapped never trips (e.g. the network's expected epoch is
+// miscalculated because of clock skew).
+var InitialSyncTimeThreshold = 15 * time.Minute
+
+// BootstrapEpochThreshold is how close, in epochs, the local head must be to
+// the network's expected epoch (derived from genesis time and block delay)
+// before the node is considered caught up with the network.
+var BootstrapEpochThreshold = abi.ChainEpoch(10)
+
+// ForkWeightMargin is the minimum additional parent weight a sideways fork
+// must carry over an active sync's target, once the node is no longer
+// bootstrapping, before the manager starts a separate worker for it; the
+// active sync is not canceled.
+// Below this margin addSyncTarget keeps extending the chain it is already
+// syncing rather than racing every marginally heavier fork to the head.
+var ForkWeightMargin = types.NewInt(0)
+
+// PreemptWeightMargin is how much heavier an extension of an active sync's
+// target must be before the manager preempts that sync instead of just
+// queuing the extension to run once it finishes. This lets a long tail-end
+// sync racing stale blocks get preempted by a legitimately heavier
+// descendant, instead of always waiting it out.
+var PreemptWeightMargin = types.NewInt(0)
+
+// PeerHeadMinInterval is the minimum spacing enforced between accepted
+// SetPeerHead calls from a single peer; calls arriving faster are dropped
+// rather than scheduled, so a peer can't force repeated, expensive doSync
+// invocations just by spamming fork tips.
+var PeerHeadMinInterval = 2 * time.Second
+
+// TsOriginCacheSize bounds how many not-yet-synced tipset origins the
+// manager remembers for scorePeerForTarget attribution. Entries are evicted
+// oldest-first once the cache grows past this size, so a peer whose reported
+// heads keep losing out to a heavier bucket (and so never get scored and
+// removed the normal way) can't grow sm.tsOrigin without bound.
+var TsOriginCacheSize = 256
+
+// PeerErrorThreshold and PeerBadBlockThreshold are the number of
+// error-producing, respectively bad-block-tainted, heads a peer may
+// contribute before SetPeerHead starts dropping all further submissions
+// from it.
+var (
+	PeerErrorThreshold    uint64 = 5
+	PeerBadBlockThreshold uint64 = 3
+)
+
 var coalesceForksParents = false
 
 func init() {
@@ -25,6 +89,42 @@ func init() {
 
 type SyncFunc func(context.Context, *types.TipSet) error
 
+// BadBlockError may optionally be implemented by errors returned from
+// doSync to flag that the sync failed because the target was tainted by a
+// known-bad block, rather than a transient failure. Peers that report such
+// heads are scored more harshly than for an ordinary sync error.
+type BadBlockError interface {
+	error
+	BadBlock() bool
+}
+
+// PeerGater is the subset of the libp2p connection manager's tagging API
+// that the sync manager needs in order to penalize misbehaving peers; it is
+// satisfied by connmgr.ConnManager. It is optional: if none is configured,
+// misbehaving peers are still dropped by SetPeerHead, just not tagged for
+// the connection manager to prune.
+type PeerGater interface {
+	TagPeer(p peer.ID, tag string, val int)
+	UntagPeer(p peer.ID, tag string)
+}
+
+// PeerSyncScore is a snapshot of a peer's SetPeerHead behavior.
+type PeerSyncScore struct {
+	Heads     uint64
+	Errors    uint64
+	BadBlocks uint64
+	Banned    bool
+}
+
+// peerScore is the mutable, lock-guarded bookkeeping behind a PeerSyncScore.
+type peerScore struct {
+	heads      uint64
+	errors     uint64
+	badBlocks  uint64
+	lastHeadAt time.Time
+	banned     bool
+}
+
 // SyncManager manages the chain synchronization process, both at bootstrap time
 // and during ongoing operation.
 //
@@ -44,6 +144,33 @@ type SyncManager interface {
 
 	// State retrieves the state of the sync workers.
 	State() []SyncerStateSnapshot
+
+	// RecentSyncs returns state for the last few completed syncs, most recent
+	// last, so that RPC consumers can correlate ongoing work from State with
+	// what has already run.
+	RecentSyncs() []SyncerStateSnapshot
+
+	// SetMaxWorkers sets the maximum number of sync workers that may run
+	// concurrently; it may be called at runtime to tune parallelism.
+	SetMaxWorkers(n int)
+
+	// IsBootstrapped reports whether the node has left bootstrap mode: false
+	// while it is still catching up to the network (initial sync), true once a
+	// completed sync's target was near the expected network epoch or
+	// InitialSyncTimeThreshold has elapsed since bootstrap began.
+	IsBootstrapped() bool
+
+	// PeerScores returns each known peer's current SetPeerHead behavior
+	// score, for observability and operator tooling.
+	PeerScores() map[peer.ID]PeerSyncScore
+
+	// SetPeerGater configures the connection manager used to tag misbehaving
+	// peers so they become preferred candidates for pruning; may be nil.
+	SetPeerGater(g PeerGater)
+
+	// CancelWorker cancels the sync worker with the given id, if it is still
+	// active; for operator use in aborting a stuck or undesired sync.
+	CancelWorker(id uint64) error
 }
 
 type syncManager struct {
@@ -52,13 +179,32 @@ type syncManager struct {
 
 	workq   chan peerHead
 	statusq chan workerStatus
+	kick    chan struct{}
 
 	nextWorker uint64
 	pend       syncBucketSet
 	heads      map[peer.ID]*types.TipSet
 
-	mx    sync.Mutex
-	state map[uint64]*workerState
+	mx         sync.Mutex
+	state      map[uint64]*workerState
+	history    []SyncerStateSnapshot
+	maxWorkers int
+
+	genesis        time.Time
+	bootstrapStart time.Time
+	bootstrapped   bool
+
+	// tsOrigin records which peer first reported a given tipset, so that a
+	// later sync success/failure can be attributed back to it for scoring.
+	// Entries are consumed (and removed) once scored; tsOriginOrder tracks
+	// insertion order so that entries never claimed by a sync are evicted
+	// oldest-first once TsOriginCacheSize is exceeded.
+	tsOrigin      map[types.TipSetKey]peer.ID
+	tsOriginOrder []types.TipSetKey
+
+	scoreMx   sync.Mutex
+	scores    map[peer.ID]*peerScore
+	peerGater PeerGater
 
 	doSync func(context.Context, *types.TipSet) error
 }
@@ -71,9 +217,17 @@ type peerHead struct {
 }
 
 type workerState struct {
-	id uint64
-	ts *types.TipSet
-	ss *SyncerState
+	id     uint64
+	ts     *types.TipSet
+	ss     *SyncerState
+	cancel context.CancelFunc
+
+	// targetWeight is the weight of ts, cached the first time addSyncTarget
+	// sees a tipset directly extending it (at which point ParentWeight()
+	// gives us that value exactly), so that a later, deeper descendant
+	// queued behind this worker can be compared against it for preemption.
+	targetWeight    types.BigInt
+	hasTargetWeight bool
 }
 
 type workerStatus struct {
@@ -82,7 +236,7 @@ type workerStatus struct {
 }
 
 // sync manager interface
-func NewSyncManager(sync SyncFunc) SyncManager {
+func NewSyncManager(genesis *types.TipSet, sync SyncFunc) SyncManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &syncManager{
 		ctx:    ctx,
@@ -90,9 +244,16 @@ func NewSyncManager(sync SyncFunc) SyncManager {
 
 		workq:   make(chan peerHead),
 		statusq: make(chan workerStatus),
+		kick:    make(chan struct{}, 1),
+
+		heads:      make(map[peer.ID]*types.TipSet),
+		state:      make(map[uint64]*workerState),
+		maxWorkers: MaxSyncWorkers,
 
-		heads: make(map[peer.ID]*types.TipSet),
-		state: make(map[uint64]*workerState),
+		genesis: time.Unix(int64(genesis.MinTimestamp()), 0),
+
+		tsOrigin: make(map[types.TipSetKey]peer.ID),
+		scores:   make(map[peer.ID]*peerScore),
 
 		doSync: sync,
 	}
@@ -111,6 +272,10 @@ func (sm *syncManager) Stop() {
 }
 
 func (sm *syncManager) SetPeerHead(ctx context.Context, p peer.ID, ts *types.TipSet) {
+	if !sm.admitPeerHead(p) {
+		return
+	}
+
 	select {
 	case sm.workq <- peerHead{p: p, ts: ts}:
 	case <-sm.ctx.Done():
@@ -118,6 +283,124 @@ func (sm *syncManager) SetPeerHead(ctx context.Context, p peer.ID, ts *types.Tip
 	}
 }
 
+// admitPeerHead applies per-peer rate limiting and misbehavior scoring to an
+// incoming SetPeerHead call. It returns false if the head should be dropped
+// instead of scheduled.
+func (sm *syncManager) admitPeerHead(p peer.ID) bool {
+	sm.scoreMx.Lock()
+	defer sm.scoreMx.Unlock()
+
+	sc, ok := sm.scores[p]
+	if !ok {
+		sc = new(peerScore)
+		sm.scores[p] = sc
+	}
+
+	if sc.banned {
+		return false
+	}
+
+	now := build.Clock.Now()
+	if !sc.lastHeadAt.IsZero() && now.Sub(sc.lastHeadAt) < PeerHeadMinInterval {
+		log.Debugf("dropping SetPeerHead from %s: exceeds rate limit", p)
+		return false
+	}
+	sc.lastHeadAt = now
+	sc.heads++
+
+	if sc.errors >= PeerErrorThreshold || sc.badBlocks >= PeerBadBlockThreshold {
+		log.Warnf("peer %s exceeded sync misbehavior thresholds (errors=%d, badBlocks=%d); dropping its heads", p, sc.errors, sc.badBlocks)
+		sc.banned = true
+		sm.penalizePeer(p)
+		return false
+	}
+
+	return true
+}
+
+// penalizePeer tags p as misbehaving in the connection manager, if one is
+// configured, so it becomes a preferred candidate for pruning.
+func (sm *syncManager) penalizePeer(p peer.ID) {
+	if sm.peerGater == nil {
+		return
+	}
+	sm.peerGater.TagPeer(p, "fork-spam", -1000)
+}
+
+// recordTsOrigin records that p was the first peer to report ts, if no
+// origin is already recorded for it, and evicts the oldest recorded origin
+// once TsOriginCacheSize is exceeded. Must be called with sm.mx held.
+func (sm *syncManager) recordTsOrigin(key types.TipSetKey, p peer.ID) {
+	if _, ok := sm.tsOrigin[key]; ok {
+		return
+	}
+
+	sm.tsOrigin[key] = p
+	sm.tsOriginOrder = append(sm.tsOriginOrder, key)
+
+	if len(sm.tsOriginOrder) > TsOriginCacheSize {
+		stale := sm.tsOriginOrder[0]
+		sm.tsOriginOrder = sm.tsOriginOrder[1:]
+		delete(sm.tsOrigin, stale)
+	}
+}
+
+// scorePeerForTarget attributes a completed sync's outcome back to the peer
+// that first reported target, if still known.
+func (sm *syncManager) scorePeerForTarget(target *types.TipSet, err error) {
+	sm.mx.Lock()
+	p, ok := sm.tsOrigin[target.Key()]
+	delete(sm.tsOrigin, target.Key())
+	sm.mx.Unlock()
+
+	if err == nil || errors.Is(err, context.Canceled) || !ok {
+		// a canceled sync is the manager preempting its own worker, not a
+		// fault of the peer that reported the target.
+		return
+	}
+
+	var bbe BadBlockError
+	badBlock := errors.As(err, &bbe)
+	if badBlock {
+		badBlock = bbe.BadBlock()
+	}
+
+	sm.scoreMx.Lock()
+	sc, ok := sm.scores[p]
+	if !ok {
+		sc = new(peerScore)
+		sm.scores[p] = sc
+	}
+	if badBlock {
+		sc.badBlocks++
+	} else {
+		sc.errors++
+	}
+	sm.scoreMx.Unlock()
+}
+
+func (sm *syncManager) PeerScores() map[peer.ID]PeerSyncScore {
+	sm.scoreMx.Lock()
+	defer sm.scoreMx.Unlock()
+
+	out := make(map[peer.ID]PeerSyncScore, len(sm.scores))
+	for p, sc := range sm.scores {
+		out[p] = PeerSyncScore{
+			Heads:     sc.heads,
+			Errors:    sc.errors,
+			BadBlocks: sc.badBlocks,
+			Banned:    sc.banned,
+		}
+	}
+	return out
+}
+
+func (sm *syncManager) SetPeerGater(g PeerGater) {
+	sm.scoreMx.Lock()
+	sm.peerGater = g
+	sm.scoreMx.Unlock()
+}
+
 func (sm *syncManager) State() []SyncerStateSnapshot {
 	sm.mx.Lock()
 	workerStates := make([]*workerState, 0, len(sm.state))
@@ -132,12 +415,76 @@ func (sm *syncManager) State() []SyncerStateSnapshot {
 
 	result := make([]SyncerStateSnapshot, 0, len(workerStates))
 	for _, ws := range workerStates {
-		result = append(result, ws.ss.Snapshot())
+		snap := ws.ss.Snapshot()
+		snap.WorkerID = ws.id
+		result = append(result, snap)
 	}
 
 	return result
 }
 
+func (sm *syncManager) RecentSyncs() []SyncerStateSnapshot {
+	sm.mx.Lock()
+	defer sm.mx.Unlock()
+
+	result := make([]SyncerStateSnapshot, len(sm.history))
+	copy(result, sm.history)
+	return result
+}
+
+func (sm *syncManager) SetMaxWorkers(n int) {
+	sm.mx.Lock()
+	sm.maxWorkers = n
+	sm.mx.Unlock()
+
+	// an increased limit should be honored immediately, not only the next
+	// time an unrelated worker happens to complete and triggers drainPending.
+	select {
+	case sm.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (sm *syncManager) IsBootstrapped() bool {
+	sm.mx.Lock()
+	defer sm.mx.Unlock()
+	return sm.bootstrapped
+}
+
+// networkExpectedEpoch estimates the epoch the network should be at right
+// now, based on wall-clock time elapsed since genesis and the block delay.
+func (sm *syncManager) networkExpectedEpoch() abi.ChainEpoch {
+	elapsed := build.Clock.Since(sm.genesis)
+	return abi.ChainEpoch(elapsed / (time.Duration(build.BlockDelaySecs) * time.Second))
+}
+
+// updateBootstrapped reconsiders whether the node is still bootstrapping.
+// Once the local head lands within BootstrapEpochThreshold epochs of the
+// expected network epoch, or InitialSyncTimeThreshold has elapsed since
+// bootstrap began, the node is considered caught up: addSyncTarget then
+// favors extending this chain over chasing sideways forks, rather than
+// selectInitialSyncTarget's bootstrap-time preference for the heaviest
+// cluster regardless of which chain it extends.
+func (sm *syncManager) updateBootstrapped(head *types.TipSet) {
+	sm.mx.Lock()
+	defer sm.mx.Unlock()
+
+	if sm.bootstrapped {
+		return
+	}
+
+	delta := sm.networkExpectedEpoch() - head.Height()
+	if delta < 0 {
+		delta = -delta
+	}
+
+	timedOut := !sm.bootstrapStart.IsZero() && build.Clock.Since(sm.bootstrapStart) > InitialSyncTimeThreshold
+	if delta <= BootstrapEpochThreshold || timedOut {
+		log.Infof("node is caught up with the network (epoch delta %d); leaving bootstrap mode", delta)
+		sm.bootstrapped = true
+	}
+}
+
 // sync manager internals
 func (sm *syncManager) scheduler() {
 	for {
@@ -146,6 +493,11 @@ func (sm *syncManager) scheduler() {
 			sm.handlePeerHead(head)
 		case status := <-sm.statusq:
 			sm.handleWorkerStatus(status)
+		case <-sm.kick:
+			// a tunable like maxWorkers changed at runtime; see if that
+			// frees up room to resume any parked targets now instead of
+			// waiting for the next unrelated worker to complete.
+			sm.drainPending()
 		case <-sm.ctx.Done():
 			return
 		}
@@ -155,6 +507,10 @@ func (sm *syncManager) scheduler() {
 func (sm *syncManager) handlePeerHead(head peerHead) {
 	log.Infof("new peer head: %s %s", head.p, head.ts)
 
+	sm.mx.Lock()
+	sm.recordTsOrigin(head.ts.Key(), head.p)
+	sm.mx.Unlock()
+
 	// have we started syncing yet?
 	if sm.nextWorker == 0 {
 		// track the peer head until we start syncing
@@ -174,7 +530,12 @@ func (sm *syncManager) handlePeerHead(head peerHead) {
 		}
 
 		log.Infof("selected initial sync target: %s", target)
-		sm.spawnWorker(target)
+
+		sm.mx.Lock()
+		sm.bootstrapStart = build.Clock.Now()
+		sm.mx.Unlock()
+
+		sm.maybeSpawnWorker(target)
 		return
 	}
 
@@ -188,7 +549,7 @@ func (sm *syncManager) handlePeerHead(head peerHead) {
 
 	if work {
 		log.Infof("selected sync target: %s", target)
-		sm.spawnWorker(target)
+		sm.maybeSpawnWorker(target)
 	}
 }
 
@@ -200,43 +561,149 @@ func (sm *syncManager) handleWorkerStatus(status workerStatus) {
 	delete(sm.state, status.id)
 	sm.mx.Unlock()
 
-	if status.err != nil {
+	switch {
+	case errors.Is(status.err, context.Canceled):
+		// expected: this worker was preempted by CancelWorker or by a
+		// strictly heavier extension arriving in addSyncTarget.
+		log.Infof("worker %d for %s was canceled", ws.id, ws.ts)
+	case status.err != nil:
 		// we failed to sync this target -- log it and try to work on an extended chain
 		// if there is nothing related to be worked on, we stop working on this chain.
 		log.Errorf("error during sync in %s: %s", ws.ts, status.err)
 	}
 
+	sm.recordHistory(ws, status.err)
+	sm.scorePeerForTarget(ws.ts, status.err)
+
+	// reconsider bootstrap status regardless of outcome: if every sync
+	// attempt is failing (e.g. the node is wedged on an unreachable or bad
+	// target), the epoch-distance check in updateBootstrapped will never see
+	// a successful head, and InitialSyncTimeThreshold is the only thing that
+	// can still pull it out of bootstrap mode.
+	sm.updateBootstrapped(ws.ts)
+
 	// we are done with this target, select the next sync target and spawn a worker if there is work
 	// to do, because of an extension of this chain.
 	target, work, err := sm.selectSyncTarget(ws.ts)
 	if err != nil {
 		log.Warnf("failed to select sync target: %s", err)
+	} else if work {
+		log.Infof("selected sync target: %s", target)
+		sm.maybeSpawnWorker(target)
+	}
+
+	// a worker slot just freed up; resume any parked targets while we have room
+	sm.drainPending()
+}
+
+// maybeSpawnWorker spawns a worker for target if the worker pool has spare
+// capacity; otherwise it parks target in sm.pend to be picked up by
+// drainPending once a slot frees up.
+func (sm *syncManager) maybeSpawnWorker(target *types.TipSet) {
+	sm.mx.Lock()
+	atCap := len(sm.state) >= sm.maxWorkers
+	sm.mx.Unlock()
+
+	if atCap {
+		log.Infof("sync worker pool full (%d/%d); parking %s", len(sm.state), sm.maxWorkers, target)
+		sm.pend.Insert(target)
 		return
 	}
 
-	if work {
-		log.Infof("selected sync target: %s", target)
+	sm.spawnWorker(target)
+}
+
+// drainPending spawns workers for parked sync targets, heaviest first, while
+// the worker pool has spare capacity. A parked bucket related to a tipset
+// that an active worker is still syncing is left alone: it's either an
+// extension queued behind that worker (addSyncTarget's "schedule for syncing
+// next" path) or the preempted remainder of one, and in both cases
+// selectSyncTarget is what should resume it once that worker completes, not
+// a drain triggered by some unrelated worker freeing up a slot. Spawning it
+// here too would run two workers over overlapping segments of the same
+// chain at once -- exactly what the ts.Equals(ws.ts) dedup check in
+// addSyncTarget exists to prevent for the non-parked case.
+func (sm *syncManager) drainPending() {
+	for {
+		sm.mx.Lock()
+		atCap := len(sm.state) >= sm.maxWorkers
+		var active []*types.TipSet
+		for _, ws := range sm.state {
+			active = append(active, ws.ts)
+		}
+		sm.mx.Unlock()
+
+		if atCap || sm.pend.Empty() {
+			return
+		}
+
+		b := sm.pend.PopUnrelated(active)
+		if b == nil {
+			return
+		}
+
+		target := b.heaviestTipSet()
+		log.Infof("resuming parked sync target: %s", target)
 		sm.spawnWorker(target)
 	}
 }
 
+// recordHistory appends a completed worker's final state to the recent-sync
+// ring buffer, evicting the oldest entry once RecentSyncBufferSize is
+// exceeded, so that transient sync failures can be inspected after the fact
+// without scraping logs.
+func (sm *syncManager) recordHistory(ws *workerState, err error) {
+	snap := ws.ss.Snapshot()
+	snap.WorkerID = ws.id
+	if err != nil {
+		snap.Error = err.Error()
+	}
+
+	sm.mx.Lock()
+	sm.history = append(sm.history, snap)
+	if len(sm.history) > RecentSyncBufferSize {
+		sm.history = sm.history[len(sm.history)-RecentSyncBufferSize:]
+	}
+	sm.mx.Unlock()
+}
+
 func (sm *syncManager) spawnWorker(target *types.TipSet) {
 	id := sm.nextWorker
 	sm.nextWorker++
+
+	wctx, cancel := context.WithCancel(sm.ctx)
 	ws := &workerState{
-		id: id,
-		ts: target,
-		ss: new(SyncerState),
+		id:     id,
+		ts:     target,
+		ss:     new(SyncerState),
+		cancel: cancel,
 	}
 
 	sm.mx.Lock()
 	sm.state[id] = ws
 	sm.mx.Unlock()
 
-	go sm.worker(ws)
+	go sm.worker(wctx, ws)
+}
+
+// CancelWorker cancels the sync worker with the given id, if it is still
+// active. The worker's doSync call is expected to observe ctx and return
+// promptly; the manager picks up afterwards exactly as it would for any
+// other completed worker, via the normal statusq flow.
+func (sm *syncManager) CancelWorker(id uint64) error {
+	sm.mx.Lock()
+	ws, ok := sm.state[id]
+	sm.mx.Unlock()
+
+	if !ok {
+		return xerrors.Errorf("no active sync worker with id %d", id)
+	}
+
+	ws.cancel()
+	return nil
 }
 
-func (sm *syncManager) worker(ws *workerState) {
+func (sm *syncManager) worker(ctx context.Context, ws *workerState) {
 	log.Infof("worker %d syncing in %s", ws.id, ws.ss)
 
 	start := build.Clock.Now()
@@ -244,8 +711,8 @@ func (sm *syncManager) worker(ws *workerState) {
 		log.Infof("worker %d done; took %s", ws.id, build.Clock.Since(start))
 	}()
 
-	ctx := context.WithValue(sm.ctx, syncStateKey{}, ws.ss)
-	err := sm.doSync(ctx, ws.ts)
+	sctx := context.WithValue(ctx, syncStateKey{}, ws.ss)
+	err := sm.doSync(sctx, ws.ts)
 
 	select {
 	case sm.statusq <- workerStatus{id: ws.id, err: err}:
@@ -258,19 +725,22 @@ func (sm *syncManager) worker(ws *workerState) {
 func (sm *syncManager) selectInitialSyncTarget() (*types.TipSet, error) {
 	var buckets syncBucketSet
 
-	var peerHeads []*types.TipSet
-	for _, ts := range sm.heads {
-		peerHeads = append(peerHeads, ts)
+	var peerHeads []peerHead
+	for p, ts := range sm.heads {
+		peerHeads = append(peerHeads, peerHead{p: p, ts: ts})
 	}
 	// clear the map, we don't use it any longer
 	sm.heads = nil
 
 	sort.Slice(peerHeads, func(i, j int) bool {
-		return peerHeads[i].Height() < peerHeads[j].Height()
+		return peerHeads[i].ts.Height() < peerHeads[j].ts.Height()
 	})
 
-	for _, ts := range peerHeads {
-		buckets.Insert(ts)
+	// insert by peer, rather than discarding peer attribution, so that
+	// Heaviest can factor the number of peers backing each bucket into its
+	// choice and into weight-draw reporting.
+	for _, ph := range peerHeads {
+		buckets.InsertPeer(ph.p, ph.ts)
 	}
 
 	if len(buckets.buckets) > 1 {
@@ -279,9 +749,30 @@ func (sm *syncManager) selectInitialSyncTarget() (*types.TipSet, error) {
 		// For now, just select the best cluster
 	}
 
+	// while bootstrapping we always chase the heaviest cluster we've seen,
+	// even across unrelated buckets; addSyncTarget only starts preferring the
+	// chain it's already extending once updateBootstrapped flips bootstrapped.
 	return buckets.Heaviest(), nil
 }
 
+// queueAnchored parks ts in sm.pend and tags its bucket as anchored to the
+// active worker with id workerID, so that a later, possibly much deeper
+// descendant queued behind the same worker can have its pile-up compared
+// against that worker's target weight (cached here, the first time we see a
+// tipset related to it) instead of against its own immediate parent.
+func (sm *syncManager) queueAnchored(ts *types.TipSet, workerID uint64) {
+	if ws, ok := sm.state[workerID]; ok && !ws.hasTargetWeight {
+		ws.targetWeight = ts.ParentWeight()
+		ws.hasTargetWeight = true
+	}
+
+	sm.pend.Insert(ts)
+	if b := sm.pend.BucketRelatedTo(ts); b != nil {
+		b.anchored = true
+		b.anchorWorker = workerID
+	}
+}
+
 // adds a tipset to the potential sync targets; returns true if there is a a tipset to work on.
 // this could be either a restart, eg because there is no currently scheduled sync work or a worker
 // failed or a potential fork.
@@ -303,14 +794,40 @@ func (sm *syncManager) addSyncTarget(ts *types.TipSet) (*types.TipSet, bool, err
 		}
 
 		if ts.Parents() == ws.ts.Key() {
-			// schedule for syncing next; it's an extension of an active sync
-			sm.pend.Insert(ts)
+			// it's a strict descendant of an active sync's target. ts.ParentWeight()
+			// is, by construction, exactly the weight of ws.ts -- so a direct,
+			// single-round extension can never be "significantly" heavier than
+			// ws.ts by that measure, and comparing it against
+			// ws.ts.ParentWeight() (the weight of ws.ts's *parent*, one
+			// generation further back) would come out heavier
+			// for every valid extension, preempting the sync on literally every
+			// new block. Queue it behind ws instead, anchored so that a later,
+			// meaningfully heavier pile-up behind the same worker (handled
+			// below) can still preempt once real weight backs it.
+			sm.queueAnchored(ts, ws.id)
 			return nil, false, nil
 		}
 	}
 
 	// check to see if it is related to any pending sync; if so insert it into the pending sync queue
-	if sm.pend.RelatedToAny(ts) {
+	if b := sm.pend.BucketRelatedTo(ts); b != nil {
+		if b.anchored {
+			// unlike a direct child of ws.ts, ts.ParentWeight() here reflects
+			// the weight of whatever's accumulated just ahead of it, possibly
+			// several rounds past ws.ts -- a meaningful measure of how much
+			// has piled up while ws has been syncing. Preempt once that
+			// pile-up clears PreemptWeightMargin over ws's target weight,
+			// instead of waiting out a possibly long tail-end sync while
+			// fresher, heavier blocks keep piling up at the head.
+			if ws, ok := sm.state[b.anchorWorker]; ok && ws.hasTargetWeight &&
+				ts.ParentWeight().GreaterThan(types.BigAdd(ws.targetWeight, PreemptWeightMargin)) {
+				log.Infof("preempting worker %d: pile-up at %s is significantly heavier than %s", ws.id, ts, ws.ts)
+				ws.cancel()
+			}
+			sm.queueAnchored(ts, b.anchorWorker)
+			return nil, false, nil
+		}
+
 		sm.pend.Insert(ts)
 		return nil, false, nil
 	}
@@ -318,9 +835,20 @@ func (sm *syncManager) addSyncTarget(ts *types.TipSet) (*types.TipSet, bool, err
 	// it's not related to any active or pending sync; this could be a fork in which case we
 	// start a new worker to sync it, if it is *heavier* than any active or pending set;
 	// if it is not, we ignore it.
+	//
+	// once the node is bootstrapped, the height comparison against active syncs
+	// is replaced by a weight one: a sideways fork has to clear
+	// ForkWeightMargin over every active sync's target before a worker is
+	// started for it; this keeps the node from starting a competing sync for
+	// every marginally heavier fork once it's at the head.
 	activeHeavier := false
 	for _, ws := range sm.state {
-		if ws.ts.Height() > ts.Height() {
+		if sm.bootstrapped {
+			if ts.ParentWeight().LessThan(types.BigAdd(ws.ts.ParentWeight(), ForkWeightMargin)) {
+				activeHeavier = true
+				break
+			}
+		} else if ws.ts.Height() > ts.Height() {
 			activeHeavier = true
 			break
 		}
@@ -366,6 +894,19 @@ type syncBucketSet struct {
 
 type syncTargetBucket struct {
 	tips []*types.TipSet
+
+	// peers tracks, for buckets built from peer-reported heads, which peer
+	// reported which tipset in this bucket. It is nil for buckets built
+	// without peer attribution (e.g. sm.pend), and is used to factor peer
+	// support into Heaviest's tie-breaking and weight-draw logging.
+	peers map[peer.ID]*types.TipSet
+
+	// anchored and anchorWorker record, for buckets queued behind an active
+	// sync via queueAnchored, which worker they're queued behind, so that a
+	// pile-up of descendants can be weighed against that worker's target
+	// weight for preemption instead of against its own immediate parent.
+	anchored     bool
+	anchorWorker uint64
 }
 
 func newSyncTargetBucket(tipsets ...*types.TipSet) *syncTargetBucket {
@@ -398,6 +939,17 @@ func (sbs *syncBucketSet) RelatedToAny(ts *types.TipSet) bool {
 	return false
 }
 
+// BucketRelatedTo returns the bucket related to ts, without removing it from
+// sbs, or nil if none match.
+func (sbs *syncBucketSet) BucketRelatedTo(ts *types.TipSet) *syncTargetBucket {
+	for _, b := range sbs.buckets {
+		if b.sameChainAs(ts) {
+			return b
+		}
+	}
+	return nil
+}
+
 func (sbs *syncBucketSet) Insert(ts *types.TipSet) {
 	for _, b := range sbs.buckets {
 		if b.sameChainAs(ts) {
@@ -408,10 +960,45 @@ func (sbs *syncBucketSet) Insert(ts *types.TipSet) {
 	sbs.buckets = append(sbs.buckets, newSyncTargetBucket(ts))
 }
 
-func (sbs *syncBucketSet) Pop() *syncTargetBucket {
+// InsertPeer is like Insert, but additionally records that p is backing ts,
+// so that Heaviest can factor peer support into its choice among buckets.
+func (sbs *syncBucketSet) InsertPeer(p peer.ID, ts *types.TipSet) {
+	for _, b := range sbs.buckets {
+		if b.sameChainAs(ts) {
+			b.add(ts)
+			if b.peers == nil {
+				b.peers = make(map[peer.ID]*types.TipSet)
+			}
+			b.peers[p] = ts
+			return
+		}
+	}
+
+	nb := newSyncTargetBucket(ts)
+	nb.peers = map[peer.ID]*types.TipSet{p: ts}
+	sbs.buckets = append(sbs.buckets, nb)
+}
+
+// PopUnrelated removes and returns the heaviest bucket that is not related
+// to any tipset in active, or nil if every bucket is related to one; a nil
+// result does not mean sbs is empty, only that nothing in it is safe to
+// drain right now.
+func (sbs *syncBucketSet) PopUnrelated(active []*types.TipSet) *syncTargetBucket {
 	var bestBuck *syncTargetBucket
 	var bestTs *types.TipSet
+
 	for _, b := range sbs.buckets {
+		related := false
+		for _, ts := range active {
+			if b.sameChainAs(ts) {
+				related = true
+				break
+			}
+		}
+		if related {
+			continue
+		}
+
 		hts := b.heaviestTipSet()
 		if bestBuck == nil || bestTs.ParentWeight().LessThan(hts.ParentWeight()) {
 			bestBuck = b
@@ -419,6 +1006,10 @@ func (sbs *syncBucketSet) Pop() *syncTargetBucket {
 		}
 	}
 
+	if bestBuck == nil {
+		return nil
+	}
+
 	sbs.removeBucket(bestBuck)
 
 	return bestBuck
@@ -448,18 +1039,75 @@ func (sbs *syncBucketSet) PopRelated(ts *types.TipSet) *syncTargetBucket {
 	return bOut
 }
 
+// Heaviest returns the tipset of the heaviest bucket, factoring in the
+// number of peers backing each bucket when two or more are tied on parent
+// weight. A tie between buckets with distinct tipset keys is a split-brain
+// or eclipse symptom worth surfacing, so it is logged as a "weight draw"
+// event (mirroring ChainStore.MaybeTakeHeavierTipSet's warning) before being
+// broken deterministically.
 func (sbs *syncBucketSet) Heaviest() *types.TipSet {
-	// TODO: should also consider factoring in number of peers represented by each bucket here
+	var bestBuck *syncTargetBucket
 	var bestTs *types.TipSet
+	var tied []*syncTargetBucket
+
 	for _, b := range sbs.buckets {
 		bhts := b.heaviestTipSet()
-		if bestTs == nil || bhts.ParentWeight().GreaterThan(bestTs.ParentWeight()) {
-			bestTs = bhts
+		switch {
+		case bestTs == nil || bhts.ParentWeight().GreaterThan(bestTs.ParentWeight()):
+			bestBuck, bestTs = b, bhts
+			tied = []*syncTargetBucket{b}
+		case bhts.ParentWeight().Equals(bestTs.ParentWeight()) && bhts.Key() != bestTs.Key():
+			tied = append(tied, b)
+		}
+	}
+
+	if len(tied) > 1 {
+		logWeightDraw(tied)
+
+		bestBuck = tied[0]
+		for _, b := range tied[1:] {
+			if bucketTiebreakLess(b, bestBuck) {
+				bestBuck = b
+			}
 		}
+		bestTs = bestBuck.heaviestTipSet()
 	}
+
 	return bestTs
 }
 
+// logWeightDraw emits a structured warning when two or more buckets are
+// tied on parent weight, so that eclipse and split-brain scenarios are
+// observable instead of being resolved silently.
+func logWeightDraw(tied []*syncTargetBucket) {
+	var sides []string
+	for _, b := range tied {
+		sides = append(sides, fmt.Sprintf("%s(peers=%d)", b.heaviestTipSet().Key(), len(b.peers)))
+	}
+	log.Warnw("weight draw", "buckets", len(tied), "sides", strings.Join(sides, " vs "))
+}
+
+// bucketTiebreakLess deterministically orders two weight-tied buckets: most
+// distinct peers backing the bucket wins first, since more corroboration is
+// the stronger signal of which side of a split-brain to trust; then lowest
+// min ticket; then lexicographically smallest tipset key.
+func bucketTiebreakLess(a, b *syncTargetBucket) bool {
+	if la, lb := len(a.peers), len(b.peers); la != lb {
+		return la > lb
+	}
+
+	ats, bts := a.heaviestTipSet(), b.heaviestTipSet()
+
+	at, bt := ats.MinTicket(), bts.MinTicket()
+	if at != nil && bt != nil {
+		if cmp := bytes.Compare(at.VRFProof, bt.VRFProof); cmp != 0 {
+			return cmp < 0
+		}
+	}
+
+	return ats.Key().String() < bts.Key().String()
+}
+
 func (sbs *syncBucketSet) Empty() bool {
 	return len(sbs.buckets) == 0
 }
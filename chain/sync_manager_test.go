@@ -0,0 +1,181 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func newTestSyncManager() *syncManager {
+	genesis := mock.TipSet(mock.MkBlock(nil, 0, 0))
+	sm := NewSyncManager(genesis, func(context.Context, *types.TipSet) error {
+		return nil
+	}).(*syncManager)
+	sm.nextWorker = 1 // pretend bootstrap already happened
+	return sm
+}
+
+func mkExtension(t *testing.T, parent *types.TipSet, weightInc uint64, nonce uint64) *types.TipSet {
+	t.Helper()
+	return mock.TipSet(mock.MkBlock(parent, weightInc, nonce))
+}
+
+func TestAddSyncTargetQueuesExtensionBehindActiveSync(t *testing.T) {
+	sm := newTestSyncManager()
+
+	var canceled bool
+	base := mkExtension(t, nil, 1, 1)
+	sm.state[1] = &workerState{id: 1, ts: base, ss: new(SyncerState), cancel: func() { canceled = true }}
+
+	// a single-round extension should never clear PreemptWeightMargin on its
+	// own -- it's always heavier than base by construction -- so it must
+	// queue behind the active worker, not preempt it.
+	ext := mkExtension(t, base, 1, 2)
+	target, work, err := sm.addSyncTarget(ext)
+	if err != nil {
+		t.Fatalf("addSyncTarget: %s", err)
+	}
+	if work {
+		t.Fatalf("expected addSyncTarget to queue the extension, not hand back immediate work: %s", target)
+	}
+	if !sm.pend.RelatedToAny(ext) {
+		t.Fatalf("expected extension to be parked in sm.pend")
+	}
+	if canceled {
+		t.Fatalf("a lone single-round extension must not preempt the active worker")
+	}
+}
+
+func TestAddSyncTargetPreemptsOnceQueuedExtensionsPileUp(t *testing.T) {
+	sm := newTestSyncManager()
+	old := PreemptWeightMargin
+	PreemptWeightMargin = types.NewInt(1)
+	defer func() { PreemptWeightMargin = old }()
+
+	var canceled bool
+	base := mkExtension(t, nil, 1, 1)
+	sm.state[1] = &workerState{id: 1, ts: base, ss: new(SyncerState), cancel: func() { canceled = true }}
+
+	// several rounds' worth of extensions have already queued up behind the
+	// active worker, each adding more weight than the last.
+	ext1 := mkExtension(t, base, 5, 2)
+	if _, work, err := sm.addSyncTarget(ext1); err != nil || work {
+		t.Fatalf("addSyncTarget(ext1): work=%v err=%v", work, err)
+	}
+	if canceled {
+		t.Fatalf("a single queued extension must not preempt yet")
+	}
+
+	ext2 := mkExtension(t, ext1, 5, 3)
+	target, work, err := sm.addSyncTarget(ext2)
+	if err != nil {
+		t.Fatalf("addSyncTarget(ext2): %s", err)
+	}
+	if work {
+		t.Fatalf("addSyncTarget should never hand back immediate work for a descendant of an active sync: %s", target)
+	}
+	if !canceled {
+		t.Fatalf("expected the piled-up, significantly heavier backlog to preempt the active worker")
+	}
+	if !sm.pend.RelatedToAny(ext2) {
+		t.Fatalf("expected the preempted extension to be parked for the next selectSyncTarget")
+	}
+}
+
+func TestDrainPendingSkipsBucketsRelatedToActiveSync(t *testing.T) {
+	sm := newTestSyncManager()
+	sm.maxWorkers = 2
+	// worker 1 is placed by hand below; spawned workers must not reuse its id.
+	sm.nextWorker = 2
+
+	// worker 1 is still syncing base; an extension of base is parked behind
+	// it (e.g. queued via the PreemptWeightMargin non-preempt path), and an
+	// unrelated, independent fork is also parked.
+	base := mkExtension(t, nil, 1, 1)
+	sm.state[1] = &workerState{id: 1, ts: base, ss: new(SyncerState), cancel: func() {}}
+
+	related := mkExtension(t, base, 1, 2)
+	sm.pend.Insert(related)
+
+	unrelated := mkExtension(t, nil, 5, 3)
+	sm.pend.Insert(unrelated)
+
+	sm.drainPending()
+
+	if _, ok := sm.state[1]; !ok {
+		t.Fatalf("expected worker 1 to remain untouched")
+	}
+
+	var gotUnrelated, gotRelated bool
+	for _, ws := range sm.state {
+		if ws.ts.Equals(unrelated) {
+			gotUnrelated = true
+		}
+		if ws.ts.Equals(related) {
+			gotRelated = true
+		}
+	}
+
+	if !gotUnrelated {
+		t.Fatalf("expected the unrelated parked target to be drained into a new worker")
+	}
+	if gotRelated {
+		t.Fatalf("drainPending must not spawn a worker for a target related to an already-active sync")
+	}
+	if !sm.pend.RelatedToAny(related) {
+		t.Fatalf("expected the related target to remain parked, to be resumed via selectSyncTarget instead")
+	}
+}
+
+func TestBucketTiebreakLessPrefersMorePeers(t *testing.T) {
+	weight := mkExtension(t, nil, 3, 1)
+	a := newSyncTargetBucket(weight)
+	a.peers = map[peer.ID]*types.TipSet{test.RandPeerIDFatal(t): weight}
+
+	b := newSyncTargetBucket(weight)
+	b.peers = map[peer.ID]*types.TipSet{
+		test.RandPeerIDFatal(t): weight,
+		test.RandPeerIDFatal(t): weight,
+	}
+
+	if !bucketTiebreakLess(b, a) {
+		t.Fatalf("expected the bucket with more distinct peers to win the tie-break")
+	}
+	if bucketTiebreakLess(a, b) {
+		t.Fatalf("expected the bucket with fewer distinct peers to lose the tie-break")
+	}
+}
+
+func TestRecordTsOriginKeepsFirstReporterAndEvicts(t *testing.T) {
+	sm := newTestSyncManager()
+	TsOriginCacheSizeOld := TsOriginCacheSize
+	TsOriginCacheSize = 2
+	defer func() { TsOriginCacheSize = TsOriginCacheSizeOld }()
+
+	p1, p2, p3 := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+
+	ts1 := mkExtension(t, nil, 1, 1)
+	sm.recordTsOrigin(ts1.Key(), p1)
+	sm.recordTsOrigin(ts1.Key(), p2) // should not overwrite p1
+
+	if got := sm.tsOrigin[ts1.Key()]; got != p1 {
+		t.Fatalf("expected first reporter %s to stick, got %s", p1, got)
+	}
+
+	ts2 := mkExtension(t, nil, 2, 2)
+	ts3 := mkExtension(t, nil, 3, 3)
+	sm.recordTsOrigin(ts2.Key(), p2)
+	sm.recordTsOrigin(ts3.Key(), p3)
+
+	if _, ok := sm.tsOrigin[ts1.Key()]; ok {
+		t.Fatalf("expected oldest origin to be evicted once the cache grew past TsOriginCacheSize")
+	}
+	if len(sm.tsOrigin) != 2 {
+		t.Fatalf("expected tsOrigin to stay capped at TsOriginCacheSize, got %d entries", len(sm.tsOrigin))
+	}
+}
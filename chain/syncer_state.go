@@ -0,0 +1,119 @@
+package chain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// SyncStateStage names a phase of a single sync worker's progress through a
+// target tipset, surfaced to operators via SyncerStateSnapshot.
+type SyncStateStage int
+
+const (
+	StageIdle = SyncStateStage(iota)
+	StageHeaders
+	StagePersistHeaders
+	StageMessages
+	StageSyncComplete
+	StageSyncErrored
+)
+
+func (v SyncStateStage) String() string {
+	switch v {
+	case StageIdle:
+		return "idle"
+	case StageHeaders:
+		return "header sync"
+	case StagePersistHeaders:
+		return "persisting headers"
+	case StageMessages:
+		return "message sync"
+	case StageSyncComplete:
+		return "complete"
+	case StageSyncErrored:
+		return "error"
+	default:
+		return fmt.Sprintf("<unknown sync stage %d>", int(v))
+	}
+}
+
+// SyncerState is a sync worker's live, lock-guarded progress through its
+// target tipset. doSync implementations update it via the *SyncerState
+// attached to their context (see syncStateKey) so that State() can report
+// granular progress instead of just "a sync is running."
+type SyncerState struct {
+	mx sync.Mutex
+
+	Target  *types.TipSet
+	Base    *types.TipSet
+	Stage   SyncStateStage
+	Height  abi.ChainEpoch
+	Message string
+
+	Start time.Time
+	End   time.Time
+}
+
+func (ss *SyncerState) String() string {
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+
+	if ss.Target == nil {
+		return "waiting for target"
+	}
+	return fmt.Sprintf("%s (%s)", ss.Target, ss.Stage)
+}
+
+// SetStage records which phase of the sync a worker has reached.
+func (ss *SyncerState) SetStage(v SyncStateStage) {
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+	ss.Stage = v
+}
+
+// Snapshot returns a point-in-time, JSON-RPC-safe copy of ss.
+func (ss *SyncerState) Snapshot() SyncerStateSnapshot {
+	ss.mx.Lock()
+	defer ss.mx.Unlock()
+
+	return SyncerStateSnapshot{
+		Target:  ss.Target,
+		Base:    ss.Base,
+		Stage:   ss.Stage,
+		Height:  ss.Height,
+		Message: ss.Message,
+		Start:   ss.Start,
+		End:     ss.End,
+	}
+}
+
+// SyncerStateSnapshot is a JSON-RPC-safe snapshot of a sync worker's
+// progress, returned by SyncManager.State and SyncManager.RecentSyncs.
+//
+// WorkerID and Error are filled in by the syncManager itself rather than by
+// SyncerState.Snapshot, since they describe the worker's place in the
+// manager's bookkeeping rather than the sync's own progress. Error is a
+// string rather than the error value itself, so that it actually round-trips
+// through JSON-RPC instead of marshaling to null.
+type SyncerStateSnapshot struct {
+	WorkerID uint64
+
+	Target  *types.TipSet
+	Base    *types.TipSet
+	Stage   SyncStateStage
+	Height  abi.ChainEpoch
+	Message string
+
+	Start time.Time
+	End   time.Time
+
+	Error string
+}
+
+// syncStateKey is the context key a worker's SyncerState is attached under
+// so that its doSync call can report progress into it.
+type syncStateKey struct{}